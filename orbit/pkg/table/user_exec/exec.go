@@ -1,15 +1,12 @@
-// build +darwin
-
 package user_exec
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
-	"os/user"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kolide/launcher/pkg/osquery/tables/tablehelpers"
@@ -17,71 +14,11 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// ExecOsqueryLaunchctl runs osquery under launchctl, in a user context.
-func ExecOsqueryLaunchctl(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
-	defer cancel()
-
-	targetUser, err := user.Lookup(username)
-	if err != nil {
-		return nil, fmt.Errorf("looking up username %s: %w", username, err)
-	}
-
-	cmd := exec.CommandContext(ctx,
-		"launchctl",
-		"asuser",
-		targetUser.Uid,
-		osqueryPath,
-		"--config_path", "/dev/null",
-		"--disable_events",
-		"--disable_database",
-		"--disable_audit",
-		"--ephemeral",
-		"-S",
-		"--json",
-		query,
-	)
-
-	dir, err := os.MkdirTemp("", "osq-launchctl")
-	if err != nil {
-		return nil, fmt.Errorf("mktemp: %w", err)
-	}
-	defer os.RemoveAll(dir)
-
-	if err := os.Chmod(dir, 0o755); err != nil {
-		return nil, fmt.Errorf("chmod: %w", err)
-	}
-
-	cmd.Dir = dir
-
-	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
-	cmd.Stdout, cmd.Stderr = stdout, stderr
-
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("running osquery. Got: '%s': %w", string(stderr.Bytes()), err)
-	}
-
-	return stdout.Bytes(), nil
-}
-
-func ExecOsqueryLaunchctlParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
-	outBytes, err := ExecOsqueryLaunchctl(ctx, timeoutSeconds, username, osqueryPath, query)
-	if err != nil {
-		return nil, err
-	}
-
-	var osqueryResults []map[string]string
-
-	if err := json.Unmarshal(outBytes, &osqueryResults); err != nil {
-		log.Info().Err(err).Msg("error unmarshalling json")
-		return nil, fmt.Errorf("unmarshalling json: %w", err)
-	}
-
-	return osqueryResults, nil
-}
-
 const (
 	allowedUsernameCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-. "
+
+	defaultMaxConcurrency = 4
+	defaultPerUserTimeout = 5 * time.Second
 )
 
 // struct Table provides a table generator that will
@@ -97,48 +34,325 @@ const (
 // settings, the default values are returned. If the user has
 // configured these settings, _and_ the user is not logged in, no data
 // is returned.
+//
+// The mechanics of how osquery is invoked in the target user's
+// context are platform specific -- see execOsqueryAsUserParsed in the
+// exec_darwin.go, exec_linux.go, and exec_windows.go build-tagged
+// files -- but the Table and generate logic below is shared.
+
+// ExecResult carries stdout plus execution diagnostics for a single
+// osqueryd invocation, so a `debug=1` query can explain why it got no rows
+// back instead of just dropping them.
+type ExecResult struct {
+	Stdout   []byte
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
 
 type Table struct {
 	osqueryd  string
 	query     string
 	tablename string
+
+	maxConcurrency    int
+	perUserTimeout    time.Duration
+	overallDeadline   time.Duration
+	cache             *resultCache
+	autoDiscoverUsers bool
+}
+
+// Option configures optional behavior of a Table created by TablePlugin.
+type Option func(*Table)
+
+// WithMaxConcurrency bounds how many users are queried in parallel during a
+// single generate call. The default is defaultMaxConcurrency.
+func WithMaxConcurrency(n int) Option {
+	return func(t *Table) {
+		t.maxConcurrency = n
+	}
+}
+
+// WithPerUserTimeout bounds how long a single user's osquery invocation is
+// allowed to run before it's canceled. The default is defaultPerUserTimeout.
+func WithPerUserTimeout(d time.Duration) Option {
+	return func(t *Table) {
+		t.perUserTimeout = d
+	}
+}
+
+// WithOverallDeadline bounds the wall-clock time spent across all users in a
+// single generate call, independent of the parent context's deadline. A
+// zero value (the default) leaves this up to the parent context alone.
+func WithOverallDeadline(d time.Duration) Option {
+	return func(t *Table) {
+		t.overallDeadline = d
+	}
+}
+
+// WithResultCache caches each user's results for ttl, deduplicating
+// concurrent lookups for the same (username, query, osqueryd) via
+// singleflight. Callers can bypass the cache for a single query with
+// `WHERE refresh = 1`, or override the TTL with `WHERE cache_ttl = <seconds>`.
+func WithResultCache(ttl time.Duration) Option {
+	return func(t *Table) {
+		t.cache = newResultCache(t.tablename, ttl)
+	}
+}
+
+// WithAutoDiscoverUsers enumerates logged-in users with an active GUI
+// session and queries each of them when a query omits a `user` constraint,
+// instead of hard-erroring. On Linux hosts without loginctl, discovery falls
+// back to `who`, which does not filter by session type. A query can opt into
+// this behavior explicitly, regardless of this option, with
+// `WHERE user LIKE '%'`.
+func WithAutoDiscoverUsers(enabled bool) Option {
+	return func(t *Table) {
+		t.autoDiscoverUsers = enabled
+	}
 }
 
 func TablePlugin(
-	tablename string, osqueryd string, osqueryQuery string, columns []table.ColumnDefinition,
+	tablename string, osqueryd string, osqueryQuery string, columns []table.ColumnDefinition, opts ...Option,
 ) *table.Plugin {
 	columns = append(columns, table.TextColumn("user"))
+	columns = append(columns, table.TextColumn("user_exec_errors"))
+	columns = append(columns,
+		table.ColumnDefinition{Name: "debug", Type: table.ColumnTypeInteger, Hidden: true},
+		table.ColumnDefinition{Name: "_exec_status", Type: table.ColumnTypeText, Hidden: true},
+		table.ColumnDefinition{Name: "_exec_stderr", Type: table.ColumnTypeText, Hidden: true},
+		table.ColumnDefinition{Name: "_exec_duration_ms", Type: table.ColumnTypeBigInt, Hidden: true},
+		table.ColumnDefinition{Name: "_exec_exit_code", Type: table.ColumnTypeInteger, Hidden: true},
+	)
 
 	t := &Table{
-		osqueryd:  osqueryd,
-		query:     osqueryQuery,
-		tablename: tablename,
+		osqueryd:       osqueryd,
+		query:          osqueryQuery,
+		tablename:      tablename,
+		maxConcurrency: defaultMaxConcurrency,
+		perUserTimeout: defaultPerUserTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if t.cache != nil {
+		columns = append(columns,
+			table.ColumnDefinition{Name: "cache_ttl", Type: table.ColumnTypeInteger, Hidden: true},
+			table.ColumnDefinition{Name: "refresh", Type: table.ColumnTypeInteger, Hidden: true},
+		)
+		cacheRegistry.Store(t.tablename, t.cache)
 	}
 
 	return table.NewPlugin(t.tablename, columns, t.generate)
 }
 
 func (t *Table) generate(ctx context.Context, queryContext table.QueryContext) ([]map[string]string, error) {
-	var results []map[string]string
-
 	users := tablehelpers.GetConstraints(queryContext, "user",
 		tablehelpers.WithAllowedCharacters(allowedUsernameCharacters),
 	)
 
+	if len(users) == 0 && (t.autoDiscoverUsers || userRequestsAutoDiscovery(queryContext)) {
+		discovered, err := discoverLoggedInUsers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("discovering logged in users for %s: %w", t.tablename, err)
+		}
+		users = filterAllowedUsernames(discovered)
+	}
+
 	if len(users) == 0 {
 		return nil, fmt.Errorf("The %s table requires a user", t.tablename)
 	}
 
+	if t.overallDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.overallDeadline)
+		defer cancel()
+	}
+
+	refresh := false
+	var ttlOverride time.Duration
+	if t.cache != nil {
+		for _, r := range tablehelpers.GetConstraints(queryContext, "refresh") {
+			if r == "1" {
+				refresh = true
+			}
+		}
+		for _, v := range tablehelpers.GetConstraints(queryContext, "cache_ttl") {
+			if secs, err := strconv.Atoi(v); err == nil {
+				ttlOverride = time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	debug := false
+	for _, v := range tablehelpers.GetConstraints(queryContext, "debug") {
+		if v == "1" {
+			debug = true
+		}
+	}
+
+	sem := make(chan struct{}, t.maxConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []map[string]string
+
+	recordErr := func(user string, err error) {
+		mu.Lock()
+		results = append(results, map[string]string{"user": user, "user_exec_errors": err.Error()})
+		mu.Unlock()
+	}
+
 	for _, user := range users {
-		osqueryResults, err := ExecOsqueryLaunchctlParsed(ctx, 5, user, t.osqueryd, t.query)
-		if err != nil {
+		user := user
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			recordErr(user, ctx.Err())
 			continue
 		}
 
-		for _, row := range osqueryResults {
-			row["user"] = user
-			results = append(results, row)
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			appendRow := func(row map[string]string, extra map[string]string) {
+				rowCopy := make(map[string]string, len(row)+len(extra)+1)
+				for k, v := range row {
+					rowCopy[k] = v
+				}
+				for k, v := range extra {
+					rowCopy[k] = v
+				}
+				rowCopy["user"] = user
+
+				mu.Lock()
+				results = append(results, rowCopy)
+				mu.Unlock()
+			}
+
+			recordUserErr := func(err error) {
+				log.Info().Err(err).Str("user", user).Str("table", t.tablename).Msg("error execing osquery in user context")
+				recordErr(user, err)
+			}
+
+			timeoutSeconds := int(t.perUserTimeout.Seconds())
+
+			if debug {
+				result, err := execOsqueryAsUserResult(ctx, timeoutSeconds, user, t.osqueryd, t.query)
+				if err != nil {
+					log.Info().Err(err).Str("user", user).Str("table", t.tablename).Msg("error execing osquery in user context")
+				}
+
+				rows, diagnostics := buildDebugRows(result, err)
+				if len(rows) == 0 {
+					appendRow(nil, diagnostics)
+				} else {
+					for _, row := range rows {
+						appendRow(row, diagnostics)
+					}
+				}
+				return
+			}
+
+			if t.cache != nil {
+				// Cached results must be materialized in full before
+				// they can be stored, so the cached path can't stream
+				// rows as they arrive.
+				key := cacheKey{username: user, osqueryd: t.osqueryd, query: t.query}
+				osqueryResults, err := t.cache.get(key, ttlOverride, refresh, t.perUserTimeout, func(execCtx context.Context) ([]map[string]string, error) {
+					return execOsqueryAsUserParsed(execCtx, timeoutSeconds, user, t.osqueryd, t.query)
+				})
+				if err != nil {
+					recordUserErr(err)
+					return
+				}
+				for _, row := range osqueryResults {
+					appendRow(row, nil)
+				}
+				return
+			}
+
+			rowsCh, errCh := execOsqueryAsUserStream(ctx, timeoutSeconds, user, t.osqueryd, t.query)
+			for row := range rowsCh {
+				appendRow(row, nil)
+			}
+			if err := <-errCh; err != nil {
+				recordUserErr(err)
+			}
+		}()
 	}
+
+	wg.Wait()
+
 	return results, nil
-}
\ No newline at end of file
+}
+
+// userRequestsAutoDiscovery reports whether the query explicitly asked for
+// every logged-in user via `WHERE user LIKE '%'`, which would otherwise be
+// rejected by the allowed-character filter. This lets a query opt in to
+// auto-discovery independent of WithAutoDiscoverUsers.
+func userRequestsAutoDiscovery(queryContext table.QueryContext) bool {
+	constraintList, ok := queryContext.Constraints["user"]
+	if !ok {
+		return false
+	}
+
+	for _, c := range constraintList.Constraints {
+		if c.Operator == table.OperatorLike && c.Expression == "%" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterAllowedUsernames applies the same allowed-character filter used for
+// explicit `user` constraints to a list of discovered usernames.
+func filterAllowedUsernames(usernames []string) []string {
+	var allowed []string
+	for _, u := range usernames {
+		ok := true
+		for _, r := range u {
+			if !strings.ContainsRune(allowedUsernameCharacters, r) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, u)
+		}
+	}
+	return allowed
+}
+
+// buildDebugRows interprets a debug=1 invocation's ExecResult and error into
+// the rows and shared diagnostics columns Table.generate should append. A
+// failed invocation, or one that produced no query rows, still yields a
+// single diagnostics-only row (via the caller passing rows=nil to
+// appendRow), so debug output always explains what happened even without
+// any osquery results.
+func buildDebugRows(result *ExecResult, err error) (rows []map[string]string, diagnostics map[string]string) {
+	diagnostics = map[string]string{}
+	if result != nil {
+		diagnostics["_exec_stderr"] = result.Stderr
+		diagnostics["_exec_duration_ms"] = strconv.FormatInt(result.Duration.Milliseconds(), 10)
+		diagnostics["_exec_exit_code"] = strconv.Itoa(result.ExitCode)
+	}
+
+	status := "ok"
+	switch {
+	case err != nil:
+		status = "error"
+	case result != nil && len(result.Stdout) > 0:
+		if jsonErr := json.Unmarshal(result.Stdout, &rows); jsonErr != nil {
+			status = "error"
+		}
+	}
+	diagnostics["_exec_status"] = status
+
+	return rows, diagnostics
+}
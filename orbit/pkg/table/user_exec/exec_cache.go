@@ -0,0 +1,162 @@
+package user_exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/osquery/osquery-go/plugin/table"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheKey identifies a single cacheable osquery invocation. Two requests
+// for the same user, same osqueryd binary, and same query can share a
+// cached result.
+type cacheKey struct {
+	username string
+	osqueryd string
+	query    string
+}
+
+type cacheEntry struct {
+	results   []map[string]string
+	expiresAt time.Time
+}
+
+// resultCache caches per-user osquery results for a TTL, collapsing
+// concurrent requests for the same key into a single execution via
+// singleflight.
+type resultCache struct {
+	tablename string
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	group   singleflight.Group
+
+	hits   uint64
+	misses uint64
+}
+
+func newResultCache(tablename string, ttl time.Duration) *resultCache {
+	c := &resultCache{
+		tablename: tablename,
+		ttl:       ttl,
+		entries:   make(map[cacheKey]cacheEntry),
+	}
+
+	go c.evictOnSIGHUP()
+
+	return c
+}
+
+// evictOnSIGHUP clears the cache whenever the process receives SIGHUP,
+// which launcher sends on config reload.
+func (c *resultCache) evictOnSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		c.mu.Lock()
+		c.entries = make(map[cacheKey]cacheEntry)
+		c.mu.Unlock()
+	}
+}
+
+// get executes fn and caches its result for ttl (or the override), unless
+// refresh is set, in which case the cache is bypassed and repopulated.
+//
+// A cache miss is shared via singleflight across every concurrent caller
+// for the same key, so fn is given its own context derived from
+// context.Background() plus timeout instead of any one caller's ctx:
+// otherwise the caller that happened to win the singleflight race would
+// have its cancellation or deadline applied to every other caller waiting
+// on the same group, even ones with time left on their own budget.
+func (c *resultCache) get(key cacheKey, ttlOverride time.Duration, refresh bool, timeout time.Duration, fn func(ctx context.Context) ([]map[string]string, error)) ([]map[string]string, error) {
+	ttl := c.ttl
+	if ttlOverride > 0 {
+		ttl = ttlOverride
+	}
+
+	if !refresh {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+
+		if ok && time.Now().Before(entry.expiresAt) {
+			atomic.AddUint64(&c.hits, 1)
+			return entry.results, nil
+		}
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+
+	groupKey := fmt.Sprintf("%s\x00%s\x00%s", key.username, key.osqueryd, key.query)
+	v, err, _ := c.group.Do(groupKey, func() (interface{}, error) {
+		execCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		results, err := fn(execCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.entries[key] = cacheEntry{results: results, expiresAt: time.Now().Add(ttl)}
+		c.mu.Unlock()
+
+		return results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]map[string]string), nil
+}
+
+// cacheRegistry tracks every resultCache created via WithResultCache, keyed
+// by table name, so CacheStatsTablePlugin can report on all of them.
+var cacheRegistry sync.Map // map[string]*resultCache
+
+// CacheStatsTablePlugin exposes hit/miss/size counters for every table's
+// result cache, as kolide_user_exec_cache.
+func CacheStatsTablePlugin() *table.Plugin {
+	columns := []table.ColumnDefinition{
+		table.TextColumn("tablename"),
+		table.BigIntColumn("hits"),
+		table.BigIntColumn("misses"),
+		table.BigIntColumn("entries"),
+		table.BigIntColumn("ttl_seconds"),
+	}
+
+	return table.NewPlugin("kolide_user_exec_cache", columns, generateCacheStats)
+}
+
+func generateCacheStats(ctx context.Context, queryContext table.QueryContext) ([]map[string]string, error) {
+	var results []map[string]string
+
+	cacheRegistry.Range(func(_, v interface{}) bool {
+		c := v.(*resultCache)
+
+		c.mu.Lock()
+		entries := len(c.entries)
+		c.mu.Unlock()
+
+		results = append(results, map[string]string{
+			"tablename":   c.tablename,
+			"hits":        strconv.FormatUint(atomic.LoadUint64(&c.hits), 10),
+			"misses":      strconv.FormatUint(atomic.LoadUint64(&c.misses), 10),
+			"entries":     strconv.Itoa(entries),
+			"ttl_seconds": strconv.FormatFloat(c.ttl.Seconds(), 'f', 0, 64),
+		})
+
+		return true
+	})
+
+	return results, nil
+}
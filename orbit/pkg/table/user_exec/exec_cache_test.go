@@ -0,0 +1,146 @@
+package user_exec
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultCacheGet_CachesWithinTTL(t *testing.T) {
+	t.Parallel()
+
+	c := newResultCache("test_table", time.Minute)
+	key := cacheKey{username: "alice", osqueryd: "/osqueryd", query: "select 1"}
+
+	var calls int32
+	fn := func(ctx context.Context) ([]map[string]string, error) {
+		atomic.AddInt32(&calls, 1)
+		return []map[string]string{{"col": "val"}}, nil
+	}
+
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("first get: %v", err)
+	}
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("second get: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn called %d times, want 1 (second call should hit the cache)", got)
+	}
+}
+
+func TestResultCacheGet_RefreshBypassesCache(t *testing.T) {
+	t.Parallel()
+
+	c := newResultCache("test_table", time.Minute)
+	key := cacheKey{username: "alice", osqueryd: "/osqueryd", query: "select 1"}
+
+	var calls int32
+	fn := func(ctx context.Context) ([]map[string]string, error) {
+		atomic.AddInt32(&calls, 1)
+		return []map[string]string{{"col": "val"}}, nil
+	}
+
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("first get: %v", err)
+	}
+	if _, err := c.get(key, 0, true, time.Second, fn); err != nil {
+		t.Fatalf("refresh get: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("fn called %d times, want 2 (refresh=true should bypass the cache)", got)
+	}
+}
+
+func TestResultCacheGet_ExpiresAfterTTL(t *testing.T) {
+	t.Parallel()
+
+	c := newResultCache("test_table", time.Millisecond)
+	key := cacheKey{username: "alice", osqueryd: "/osqueryd", query: "select 1"}
+
+	var calls int32
+	fn := func(ctx context.Context) ([]map[string]string, error) {
+		atomic.AddInt32(&calls, 1)
+		return []map[string]string{{"col": "val"}}, nil
+	}
+
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("first get: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("second get: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("fn called %d times, want 2 (entry should have expired)", got)
+	}
+}
+
+func TestResultCacheGet_SingleflightDedupesConcurrentMisses(t *testing.T) {
+	t.Parallel()
+
+	c := newResultCache("test_table", time.Minute)
+	key := cacheKey{username: "alice", osqueryd: "/osqueryd", query: "select 1"}
+
+	var calls int32
+	entered := make(chan struct{}, 5)
+	release := make(chan struct{})
+	fn := func(ctx context.Context) ([]map[string]string, error) {
+		atomic.AddInt32(&calls, 1)
+		entered <- struct{}{}
+		<-release
+		return []map[string]string{{"col": "val"}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+				t.Errorf("concurrent get: %v", err)
+			}
+		}()
+	}
+
+	// Hold fn open until it has been entered and the other callers have had
+	// time to queue on the same singleflight call, so the misses overlap.
+	<-entered
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn called %d times, want 1 (concurrent misses for the same key should be deduped)", got)
+	}
+}
+
+func TestResultCacheGet_ExecContextIndependentOfCaller(t *testing.T) {
+	t.Parallel()
+
+	c := newResultCache("test_table", time.Minute)
+	key := cacheKey{username: "alice", osqueryd: "/osqueryd", query: "select 1"}
+
+	// get must derive fn's context from the timeout argument rather than
+	// any caller's own ctx, so a canceled caller can't poison a concurrent
+	// caller sharing the same singleflight group.
+	var sawDeadline bool
+	fn := func(ctx context.Context) ([]map[string]string, error) {
+		_, sawDeadline = ctx.Deadline()
+		return []map[string]string{{"col": "val"}}, nil
+	}
+
+	if _, err := c.get(key, 0, false, time.Second, fn); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !sawDeadline {
+		t.Errorf("fn's context had no deadline, want one derived from the timeout argument")
+	}
+}
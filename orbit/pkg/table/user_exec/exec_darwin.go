@@ -0,0 +1,307 @@
+//go:build darwin
+// +build darwin
+
+package user_exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// ExecOsqueryLaunchctlStream runs osquery under launchctl, in a user
+// context, decoding the JSON array osqueryd writes to stdout one row at a
+// time rather than buffering the whole response. The returned rows channel
+// is closed once the command exits or ctx is done; the error channel
+// receives at most one error and is then also closed. Callers should drain
+// both.
+func ExecOsqueryLaunchctlStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	rows := make(chan map[string]string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(rows)
+		defer close(errs)
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		defer cancel()
+
+		targetUser, err := user.Lookup(username)
+		if err != nil {
+			errs <- fmt.Errorf("looking up username %s: %w", username, err)
+			return
+		}
+
+		cmd := exec.CommandContext(ctx,
+			"launchctl",
+			"asuser",
+			targetUser.Uid,
+			osqueryPath,
+			"--config_path", "/dev/null",
+			"--disable_events",
+			"--disable_database",
+			"--disable_audit",
+			"--ephemeral",
+			"-S",
+			"--json",
+			query,
+		)
+
+		dir, err := os.MkdirTemp("", "osq-launchctl")
+		if err != nil {
+			errs <- fmt.Errorf("mktemp: %w", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		if err := os.Chmod(dir, 0o755); err != nil {
+			errs <- fmt.Errorf("chmod: %w", err)
+			return
+		}
+		cmd.Dir = dir
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			errs <- fmt.Errorf("getting stdout pipe: %w", err)
+			return
+		}
+
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+
+		if err := cmd.Start(); err != nil {
+			errs <- fmt.Errorf("starting osquery: %w", err)
+			return
+		}
+
+		dec := json.NewDecoder(stdout)
+		if _, err := dec.Token(); err != nil && err != io.EOF {
+			cmd.Wait()
+			errs <- fmt.Errorf("reading json array start. Got: '%s': %w", stderr.String(), err)
+			return
+		}
+
+		for dec.More() {
+			var row map[string]string
+			if err := dec.Decode(&row); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				errs <- fmt.Errorf("decoding json row: %w", err)
+				return
+			}
+
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				cmd.Process.Kill()
+				cmd.Wait()
+				errs <- ctx.Err()
+				return
+			}
+		}
+
+		if err := cmd.Wait(); err != nil {
+			errs <- fmt.Errorf("running osquery. Got: '%s': %w", stderr.String(), err)
+		}
+	}()
+
+	return rows, errs
+}
+
+// ExecOsqueryLaunchctlParsed runs osquery under launchctl, in a user
+// context, and returns every row once the command completes. It's a thin,
+// buffering wrapper around ExecOsqueryLaunchctlStream kept for callers that
+// want the full result set rather than incremental rows.
+func ExecOsqueryLaunchctlParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	rows, errs := ExecOsqueryLaunchctlStream(ctx, timeoutSeconds, username, osqueryPath, query)
+
+	var osqueryResults []map[string]string
+	for row := range rows {
+		osqueryResults = append(osqueryResults, row)
+	}
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	return osqueryResults, nil
+}
+
+// ExecOsqueryLaunchctl runs osquery under launchctl, in a user context,
+// returning the result as JSON bytes. It's kept for backward compatibility
+// with callers that want bytes rather than rows; the bytes are the decoded
+// rows re-encoded with json.Marshal, not osqueryd's raw stdout, so a query
+// with no rows yields `null`. ExecOsqueryLaunchctlParsed (or the streaming
+// API) should be preferred for new code.
+func ExecOsqueryLaunchctl(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]byte, error) {
+	osqueryResults, err := ExecOsqueryLaunchctlParsed(ctx, timeoutSeconds, username, osqueryPath, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(osqueryResults)
+}
+
+// ExecOsqueryLaunchctlResult runs osquery under launchctl, in a user
+// context, and returns an ExecResult carrying stdout alongside stderr, the
+// process's exit code, and wall-clock duration -- even when the command
+// fails, so callers can surface diagnostics instead of just an error.
+func ExecOsqueryLaunchctlResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	targetUser, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("looking up username %s: %w", username, err)
+	}
+
+	cmd := exec.CommandContext(ctx,
+		"launchctl",
+		"asuser",
+		targetUser.Uid,
+		osqueryPath,
+		"--config_path", "/dev/null",
+		"--disable_events",
+		"--disable_database",
+		"--disable_audit",
+		"--ephemeral",
+		"-S",
+		"--json",
+		query,
+	)
+
+	dir, err := os.MkdirTemp("", "osq-launchctl")
+	if err != nil {
+		return nil, fmt.Errorf("mktemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("chmod: %w", err)
+	}
+	cmd.Dir = dir
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	runErr := cmd.Run()
+	result := &ExecResult{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if runErr != nil {
+		return result, fmt.Errorf("running osquery. Got: '%s': %w", stderr.String(), runErr)
+	}
+
+	return result, nil
+}
+
+// execOsqueryAsUserParsed is the darwin implementation of the cross-platform
+// dispatcher used by Table.generate. It shells out via launchctl asuser.
+func execOsqueryAsUserParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	return ExecOsqueryLaunchctlParsed(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserStream is the darwin implementation of the
+// cross-platform streaming dispatcher used by Table.generate.
+func execOsqueryAsUserStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	return ExecOsqueryLaunchctlStream(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserResult is the darwin implementation of the
+// cross-platform diagnostics dispatcher used by Table.generate's debug=1
+// path.
+func execOsqueryAsUserResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	return ExecOsqueryLaunchctlResult(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// discoverLoggedInUsers enumerates users with an active GUI session on
+// darwin via `scutil --listsessions`, falling back to `who` (filtered to
+// console sessions) if scutil's output can't be parsed.
+func discoverLoggedInUsers(ctx context.Context) ([]string, error) {
+	if users, err := discoverUsersScutil(ctx); err == nil && len(users) > 0 {
+		return users, nil
+	}
+
+	return discoverUsersWho(ctx)
+}
+
+func discoverUsersScutil(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "scutil", "--listsessions").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("scutil --listsessions: %w", err)
+	}
+
+	var users []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "kCGSSessionUserNameKey") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		name := strings.TrimSpace(fields[1])
+		if name == "" || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		users = append(users, name)
+	}
+
+	return users, scanner.Err()
+}
+
+func discoverUsersWho(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "who").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("who: %w", err)
+	}
+
+	var users []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "console") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		users = append(users, name)
+	}
+
+	return users, scanner.Err()
+}
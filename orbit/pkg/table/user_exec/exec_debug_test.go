@@ -0,0 +1,88 @@
+package user_exec
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuildDebugRows(t *testing.T) {
+	t.Parallel()
+
+	t.Run("success with rows", func(t *testing.T) {
+		t.Parallel()
+
+		result := &ExecResult{Stdout: []byte(`[{"col":"val"}]`), Stderr: "", ExitCode: 0}
+		rows, diagnostics := buildDebugRows(result, nil)
+
+		if len(rows) != 1 || rows[0]["col"] != "val" {
+			t.Fatalf("rows = %v, want one row with col=val", rows)
+		}
+		if diagnostics["_exec_status"] != "ok" {
+			t.Errorf("_exec_status = %q, want ok", diagnostics["_exec_status"])
+		}
+		if diagnostics["_exec_exit_code"] != "0" {
+			t.Errorf("_exec_exit_code = %q, want 0", diagnostics["_exec_exit_code"])
+		}
+	})
+
+	t.Run("success with no rows", func(t *testing.T) {
+		t.Parallel()
+
+		result := &ExecResult{Stdout: []byte(`[]`)}
+		rows, diagnostics := buildDebugRows(result, nil)
+
+		if len(rows) != 0 {
+			t.Fatalf("rows = %v, want none", rows)
+		}
+		if diagnostics["_exec_status"] != "ok" {
+			t.Errorf("_exec_status = %q, want ok", diagnostics["_exec_status"])
+		}
+	})
+
+	t.Run("exec error", func(t *testing.T) {
+		t.Parallel()
+
+		result := &ExecResult{Stderr: "boom", ExitCode: 1}
+		rows, diagnostics := buildDebugRows(result, errors.New("osqueryd exited with code 1"))
+
+		if len(rows) != 0 {
+			t.Fatalf("rows = %v, want none", rows)
+		}
+		if diagnostics["_exec_status"] != "error" {
+			t.Errorf("_exec_status = %q, want error", diagnostics["_exec_status"])
+		}
+		if diagnostics["_exec_stderr"] != "boom" {
+			t.Errorf("_exec_stderr = %q, want boom", diagnostics["_exec_stderr"])
+		}
+	})
+
+	t.Run("unparseable stdout", func(t *testing.T) {
+		t.Parallel()
+
+		result := &ExecResult{Stdout: []byte("not json")}
+		rows, diagnostics := buildDebugRows(result, nil)
+
+		if len(rows) != 0 {
+			t.Fatalf("rows = %v, want none", rows)
+		}
+		if diagnostics["_exec_status"] != "error" {
+			t.Errorf("_exec_status = %q, want error", diagnostics["_exec_status"])
+		}
+	})
+
+	t.Run("nil result", func(t *testing.T) {
+		t.Parallel()
+
+		rows, diagnostics := buildDebugRows(nil, errors.New("no active session"))
+
+		if len(rows) != 0 {
+			t.Fatalf("rows = %v, want none", rows)
+		}
+		if diagnostics["_exec_status"] != "error" {
+			t.Errorf("_exec_status = %q, want error", diagnostics["_exec_status"])
+		}
+		if _, ok := diagnostics["_exec_stderr"]; ok {
+			t.Errorf("diagnostics unexpectedly has _exec_stderr for a nil result")
+		}
+	})
+}
@@ -0,0 +1,426 @@
+//go:build linux
+// +build linux
+
+package user_exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ExecOsqueryAsUserSystemd runs osquery in the given user's context on
+// Linux using "systemd-run --uid=<uid> --gid=<gid> --pipe --wait --quiet
+// --scope". Hosts without systemd (or without a user session bus) fall
+// back to "runuser -u <name> --".
+func ExecOsqueryAsUserSystemd(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	targetUser, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("looking up username %s: %w", username, err)
+	}
+
+	dir, err := os.MkdirTemp("", "osq-systemd-run")
+	if err != nil {
+		return nil, fmt.Errorf("mktemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("chmod: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx,
+		"systemd-run",
+		"--uid="+targetUser.Uid,
+		"--gid="+targetUser.Gid,
+		"--pipe",
+		"--wait",
+		"--quiet",
+		"--scope",
+		osqueryPath,
+		"--config_path", "/dev/null",
+		"--disable_events",
+		"--disable_database",
+		"--disable_audit",
+		"--ephemeral",
+		"-S",
+		"--json",
+		query,
+	)
+	cmd.Dir = dir
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		runuserOut, runuserErr := execOsqueryRunuser(ctx, targetUser, osqueryPath, query, dir)
+		if runuserErr == nil {
+			return runuserOut, nil
+		}
+		return nil, fmt.Errorf("running osquery via systemd-run. Got: '%s': %w", stderr.String(), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// ExecOsqueryAsUserSystemdStream runs osquery in the given user's context
+// via "systemd-run --pipe", decoding the JSON array osqueryd writes to
+// stdout one row at a time rather than buffering the whole response. The
+// returned rows channel is closed once the command exits or ctx is done;
+// the error channel receives at most one error and is then also closed.
+// Callers should drain both. If systemd-run itself fails to start (e.g. a
+// container with no systemd instance), this falls back to runuser the same
+// way ExecOsqueryAsUserSystemd does, buffering that invocation's output
+// since there's nothing left to stream incrementally by that point. Once
+// systemd-run has started and rows may already be in flight, there's no
+// falling back -- a partially-streamed result can't be recovered into a
+// fresh runuser attempt.
+func ExecOsqueryAsUserSystemdStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	rows := make(chan map[string]string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(rows)
+		defer close(errs)
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		defer cancel()
+
+		targetUser, err := user.Lookup(username)
+		if err != nil {
+			errs <- fmt.Errorf("looking up username %s: %w", username, err)
+			return
+		}
+
+		dir, err := os.MkdirTemp("", "osq-systemd-run")
+		if err != nil {
+			errs <- fmt.Errorf("mktemp: %w", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		if err := os.Chmod(dir, 0o755); err != nil {
+			errs <- fmt.Errorf("chmod: %w", err)
+			return
+		}
+
+		cmd := exec.CommandContext(ctx,
+			"systemd-run",
+			"--uid="+targetUser.Uid,
+			"--gid="+targetUser.Gid,
+			"--pipe",
+			"--wait",
+			"--quiet",
+			"--scope",
+			osqueryPath,
+			"--config_path", "/dev/null",
+			"--disable_events",
+			"--disable_database",
+			"--disable_audit",
+			"--ephemeral",
+			"-S",
+			"--json",
+			query,
+		)
+		cmd.Dir = dir
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			errs <- fmt.Errorf("getting stdout pipe: %w", err)
+			return
+		}
+
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+
+		if err := cmd.Start(); err != nil {
+			streamRunuserFallback(ctx, targetUser, osqueryPath, query, dir, rows, errs, stderr, err)
+			return
+		}
+
+		dec := json.NewDecoder(stdout)
+		if _, err := dec.Token(); err != nil && err != io.EOF {
+			cmd.Wait()
+			errs <- fmt.Errorf("reading json array start. Got: '%s': %w", stderr.String(), err)
+			return
+		}
+
+		for dec.More() {
+			var row map[string]string
+			if err := dec.Decode(&row); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				errs <- fmt.Errorf("decoding json row: %w", err)
+				return
+			}
+
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				cmd.Process.Kill()
+				cmd.Wait()
+				errs <- ctx.Err()
+				return
+			}
+		}
+
+		if err := cmd.Wait(); err != nil {
+			errs <- fmt.Errorf("running osquery via systemd-run. Got: '%s': %w", stderr.String(), err)
+		}
+	}()
+
+	return rows, errs
+}
+
+// execOsqueryRunuser is the fallback used on hosts where systemd-run is
+// unavailable, e.g. containers without a running systemd instance.
+func execOsqueryRunuser(ctx context.Context, targetUser *user.User, osqueryPath string, query string, dir string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx,
+		"runuser",
+		"-u", targetUser.Username,
+		"--",
+		osqueryPath,
+		"--config_path", "/dev/null",
+		"--disable_events",
+		"--disable_database",
+		"--disable_audit",
+		"--ephemeral",
+		"-S",
+		"--json",
+		query,
+	)
+	cmd.Dir = dir
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running osquery via runuser. Got: '%s': %w", stderr.String(), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// streamRunuserFallback retries a failed systemd-run start via runuser,
+// unmarshalling its buffered output and replaying it onto rows so callers of
+// ExecOsqueryAsUserSystemdStream see the same fallback ExecOsqueryAsUserSystemd
+// gives non-streaming callers. startErr and systemdStderr describe the
+// systemd-run failure being recovered from, for the error returned if
+// runuser fails too.
+func streamRunuserFallback(ctx context.Context, targetUser *user.User, osqueryPath string, query string, dir string, rows chan<- map[string]string, errs chan<- error, systemdStderr *bytes.Buffer, startErr error) {
+	runuserOut, runuserErr := execOsqueryRunuser(ctx, targetUser, osqueryPath, query, dir)
+	if runuserErr != nil {
+		errs <- fmt.Errorf("starting osquery via systemd-run. Got: '%s': %w", systemdStderr.String(), startErr)
+		return
+	}
+
+	var osqueryResults []map[string]string
+	if err := json.Unmarshal(runuserOut, &osqueryResults); err != nil {
+		errs <- fmt.Errorf("unmarshalling runuser fallback json: %w", err)
+		return
+	}
+
+	for _, row := range osqueryResults {
+		select {
+		case rows <- row:
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		}
+	}
+}
+
+func ExecOsqueryAsUserSystemdParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	outBytes, err := ExecOsqueryAsUserSystemd(ctx, timeoutSeconds, username, osqueryPath, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var osqueryResults []map[string]string
+
+	if err := json.Unmarshal(outBytes, &osqueryResults); err != nil {
+		log.Info().Err(err).Msg("error unmarshalling json")
+		return nil, fmt.Errorf("unmarshalling json: %w", err)
+	}
+
+	return osqueryResults, nil
+}
+
+// ExecOsqueryAsUserSystemdResult runs osquery via systemd-run, in the given
+// user's context, and returns an ExecResult carrying stdout alongside
+// stderr, the process's exit code, and wall-clock duration -- even when the
+// command fails, so callers can surface diagnostics instead of just an
+// error. Unlike ExecOsqueryAsUserSystemd, it does not fall back to runuser,
+// so the diagnostics always describe the systemd-run invocation.
+func ExecOsqueryAsUserSystemdResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	targetUser, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("looking up username %s: %w", username, err)
+	}
+
+	dir, err := os.MkdirTemp("", "osq-systemd-run")
+	if err != nil {
+		return nil, fmt.Errorf("mktemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("chmod: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx,
+		"systemd-run",
+		"--uid="+targetUser.Uid,
+		"--gid="+targetUser.Gid,
+		"--pipe",
+		"--wait",
+		"--quiet",
+		"--scope",
+		osqueryPath,
+		"--config_path", "/dev/null",
+		"--disable_events",
+		"--disable_database",
+		"--disable_audit",
+		"--ephemeral",
+		"-S",
+		"--json",
+		query,
+	)
+	cmd.Dir = dir
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	runErr := cmd.Run()
+	result := &ExecResult{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if runErr != nil {
+		return result, fmt.Errorf("running osquery via systemd-run. Got: '%s': %w", stderr.String(), runErr)
+	}
+
+	return result, nil
+}
+
+// execOsqueryAsUserParsed is the linux implementation of the cross-platform
+// dispatcher used by Table.generate.
+func execOsqueryAsUserParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	return ExecOsqueryAsUserSystemdParsed(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserStream is the linux implementation of the
+// cross-platform streaming dispatcher used by Table.generate.
+func execOsqueryAsUserStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	return ExecOsqueryAsUserSystemdStream(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserResult is the linux implementation of the
+// cross-platform diagnostics dispatcher used by Table.generate's debug=1
+// path.
+func execOsqueryAsUserResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	return ExecOsqueryAsUserSystemdResult(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// discoverLoggedInUsers enumerates users with an active graphical session
+// on Linux via `loginctl list-sessions`, falling back to `who` (which reads
+// the live utmp/wtmp session database) when loginctl/systemd-logind isn't
+// available. The `who` fallback returns every logged-in user it lists; it
+// does not filter by session type, so terminal and SSH sessions are
+// included.
+func discoverLoggedInUsers(ctx context.Context) ([]string, error) {
+	if users, err := discoverUsersLoginctl(ctx); err == nil && len(users) > 0 {
+		return users, nil
+	}
+
+	return discoverUsersWtmp(ctx)
+}
+
+func discoverUsersLoginctl(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "loginctl", "list-sessions", "--no-legend").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("loginctl list-sessions: %w", err)
+	}
+
+	var users []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		sessionID, username := fields[0], fields[2]
+		if seen[username] {
+			continue
+		}
+
+		showOut, err := exec.CommandContext(ctx, "loginctl", "show-session", sessionID, "-p", "Type", "-p", "Active").CombinedOutput()
+		if err != nil {
+			continue
+		}
+		if !bytes.Contains(showOut, []byte("Active=yes")) {
+			continue
+		}
+		if !bytes.Contains(showOut, []byte("Type=x11")) && !bytes.Contains(showOut, []byte("Type=wayland")) {
+			continue
+		}
+
+		seen[username] = true
+		users = append(users, username)
+	}
+
+	return users, scanner.Err()
+}
+
+func discoverUsersWtmp(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "who").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("who: %w", err)
+	}
+
+	var users []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		users = append(users, name)
+	}
+
+	return users, scanner.Err()
+}
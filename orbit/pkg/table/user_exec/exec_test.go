@@ -0,0 +1,71 @@
+package user_exec
+
+import (
+	"testing"
+
+	"github.com/osquery/osquery-go/plugin/table"
+)
+
+func TestFilterAllowedUsernames(t *testing.T) {
+	t.Parallel()
+
+	got := filterAllowedUsernames([]string{"alice", "bob smith", "bad;user", "carol-99", "root$"})
+	want := []string{"alice", "bob smith", "carol-99"}
+
+	if len(got) != len(want) {
+		t.Fatalf("filterAllowedUsernames(...) = %v, want %v", got, want)
+	}
+	for i, u := range want {
+		if got[i] != u {
+			t.Fatalf("filterAllowedUsernames(...)[%d] = %q, want %q", i, got[i], u)
+		}
+	}
+}
+
+func TestUserRequestsAutoDiscovery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		qc   table.QueryContext
+		want bool
+	}{
+		{
+			name: "no user constraint",
+			qc:   table.QueryContext{Constraints: map[string]table.ConstraintList{}},
+			want: false,
+		},
+		{
+			name: "equals constraint",
+			qc: table.QueryContext{Constraints: map[string]table.ConstraintList{
+				"user": {Constraints: []table.Constraint{{Operator: table.OperatorEquals, Expression: "alice"}}},
+			}},
+			want: false,
+		},
+		{
+			name: "like wildcard",
+			qc: table.QueryContext{Constraints: map[string]table.ConstraintList{
+				"user": {Constraints: []table.Constraint{{Operator: table.OperatorLike, Expression: "%"}}},
+			}},
+			want: true,
+		},
+		{
+			name: "like non-wildcard",
+			qc: table.QueryContext{Constraints: map[string]table.ConstraintList{
+				"user": {Constraints: []table.Constraint{{Operator: table.OperatorLike, Expression: "al%"}}},
+			}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := userRequestsAutoDiscovery(tt.qc); got != tt.want {
+				t.Errorf("userRequestsAutoDiscovery(...) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,552 @@
+//go:build windows
+// +build windows
+
+package user_exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modwtsapi32 = syscall.NewLazyDLL("wtsapi32.dll")
+	moduserenv  = syscall.NewLazyDLL("userenv.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procWTSGetActiveConsoleSessionID = modkernel32.NewProc("WTSGetActiveConsoleSessionId")
+	procWTSQueryUserToken            = modwtsapi32.NewProc("WTSQueryUserToken")
+	procCreateEnvironmentBlock       = moduserenv.NewProc("CreateEnvironmentBlock")
+	procDestroyEnvironmentBlock      = moduserenv.NewProc("DestroyEnvironmentBlock")
+	procCreateProcessAsUserW         = modadvapi32.NewProc("CreateProcessAsUserW")
+	procWTSEnumerateSessionsW        = modwtsapi32.NewProc("WTSEnumerateSessionsW")
+	procWTSFreeMemory                = modwtsapi32.NewProc("WTSFreeMemory")
+	procWTSQuerySessionInformationW  = modwtsapi32.NewProc("WTSQuerySessionInformationW")
+	procGetExitCodeProcess           = modkernel32.NewProc("GetExitCodeProcess")
+)
+
+// wtsSessionInfo mirrors the WTS_SESSION_INFO struct returned by
+// WTSEnumerateSessionsW.
+type wtsSessionInfo struct {
+	SessionID      uint32
+	WinStationName *uint16
+	State          uint32
+}
+
+const (
+	wtsActive       = 0
+	wtsUserNameInfo = 5
+)
+
+const (
+	createUnicodeEnvironment = 0x00000400
+	createNoWindow           = 0x08000000
+	startfUsestdhandles      = 0x00000100
+)
+
+// quoteWindowsArg wraps arg in double quotes for inclusion in a Win32
+// command line, escaping embedded quotes and the backslashes that
+// immediately precede them per the Microsoft C runtime's argv-parsing
+// rules. It's applied to every path/value interpolated into cmdLine,
+// since CreateProcessAsUserW parses the whole command line as one string
+// rather than taking an argv slice.
+func quoteWindowsArg(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	backslashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			backslashes++
+			b.WriteRune(r)
+		case '"':
+			for ; backslashes > 0; backslashes-- {
+				b.WriteByte('\\')
+			}
+			b.WriteString(`\"`)
+		default:
+			backslashes = 0
+			b.WriteRune(r)
+		}
+	}
+	for ; backslashes > 0; backslashes-- {
+		b.WriteByte('\\')
+	}
+
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ExecOsqueryAsUserWindowsStream runs osquery in the context of username's
+// active WTS session, decoding the JSON array osqueryd writes to stdout one
+// row at a time rather than buffering the whole response. The returned rows
+// channel is closed once the command exits or ctx is done; the error
+// channel receives at most one error and is then also closed. Callers
+// should drain both. A non-zero exit code, checked via GetExitCodeProcess,
+// is reported as an error even if osqueryd managed to write some rows
+// first.
+func ExecOsqueryAsUserWindowsStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	rows := make(chan map[string]string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(rows)
+		defer close(errs)
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		defer cancel()
+
+		sessionID, err := findUserSessionID(username)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		var userToken syscall.Handle
+		ret, _, err := procWTSQueryUserToken.Call(uintptr(sessionID), uintptr(unsafe.Pointer(&userToken)))
+		if ret == 0 {
+			errs <- fmt.Errorf("WTSQueryUserToken for session %d: %w", sessionID, err)
+			return
+		}
+		defer syscall.CloseHandle(userToken)
+
+		dir, err := os.MkdirTemp("", "osq-createprocess")
+		if err != nil {
+			errs <- fmt.Errorf("mktemp: %w", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+		dirPtr, err := syscall.UTF16PtrFromString(dir)
+		if err != nil {
+			errs <- fmt.Errorf("encoding working directory: %w", err)
+			return
+		}
+
+		var envBlock uintptr
+		if ret, _, err := procCreateEnvironmentBlock.Call(uintptr(unsafe.Pointer(&envBlock)), uintptr(userToken), 0); ret == 0 {
+			errs <- fmt.Errorf("CreateEnvironmentBlock: %w", err)
+			return
+		}
+		defer procDestroyEnvironmentBlock.Call(envBlock)
+
+		cmdLine := fmt.Sprintf(`%s --config_path NUL --disable_events --disable_database --disable_audit --ephemeral -S --json %s`, quoteWindowsArg(osqueryPath), quoteWindowsArg(query))
+		cmdLinePtr, err := syscall.UTF16PtrFromString(cmdLine)
+		if err != nil {
+			errs <- fmt.Errorf("encoding command line: %w", err)
+			return
+		}
+
+		stdoutRead, stdoutWrite, err := os.Pipe()
+		if err != nil {
+			errs <- fmt.Errorf("creating stdout pipe: %w", err)
+			return
+		}
+		defer stdoutRead.Close()
+
+		stderrRead, stderrWrite, err := os.Pipe()
+		if err != nil {
+			errs <- fmt.Errorf("creating stderr pipe: %w", err)
+			return
+		}
+		defer stderrRead.Close()
+
+		si := new(syscall.StartupInfo)
+		si.Cb = uint32(unsafe.Sizeof(*si))
+		si.Flags = startfUsestdhandles
+		si.StdOutput = syscall.Handle(stdoutWrite.Fd())
+		si.StdErr = syscall.Handle(stderrWrite.Fd())
+
+		pi := new(syscall.ProcessInformation)
+
+		ret, _, err = procCreateProcessAsUserW.Call(
+			uintptr(userToken),
+			0,
+			uintptr(unsafe.Pointer(cmdLinePtr)),
+			0,
+			0,
+			1,
+			uintptr(createUnicodeEnvironment|createNoWindow),
+			envBlock,
+			uintptr(unsafe.Pointer(dirPtr)),
+			uintptr(unsafe.Pointer(si)),
+			uintptr(unsafe.Pointer(pi)),
+		)
+		stdoutWrite.Close()
+		stderrWrite.Close()
+		if ret == 0 {
+			errs <- fmt.Errorf("CreateProcessAsUserW: %w", err)
+			return
+		}
+		defer syscall.CloseHandle(pi.Process)
+		defer syscall.CloseHandle(pi.Thread)
+
+		var stderr bytes.Buffer
+		stderrDone := make(chan struct{})
+		go func() {
+			stderr.ReadFrom(stderrRead)
+			close(stderrDone)
+		}()
+
+		kill := func() {
+			syscall.TerminateProcess(pi.Process, 1)
+		}
+
+		// Terminate osqueryd once ctx is done, so a decoder blocked on a
+		// read returns instead of waiting for the process to exit.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				kill()
+			case <-stop:
+			}
+		}()
+
+		dec := json.NewDecoder(stdoutRead)
+		if _, err := dec.Token(); err != nil && err != io.EOF {
+			kill()
+			syscall.WaitForSingleObject(pi.Process, syscall.INFINITE)
+			<-stderrDone
+			errs <- fmt.Errorf("reading json array start. Got: '%s': %w", stderr.String(), err)
+			return
+		}
+
+		for dec.More() {
+			var row map[string]string
+			if err := dec.Decode(&row); err != nil {
+				kill()
+				syscall.WaitForSingleObject(pi.Process, syscall.INFINITE)
+				<-stderrDone
+				errs <- fmt.Errorf("decoding json row: %w", err)
+				return
+			}
+
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				kill()
+				syscall.WaitForSingleObject(pi.Process, syscall.INFINITE)
+				<-stderrDone
+				errs <- ctx.Err()
+				return
+			}
+		}
+
+		if _, err := syscall.WaitForSingleObject(pi.Process, syscall.INFINITE); err != nil {
+			<-stderrDone
+			errs <- fmt.Errorf("waiting for osqueryd: %w", err)
+			return
+		}
+		<-stderrDone
+
+		var exitCode uint32
+		procGetExitCodeProcess.Call(uintptr(pi.Process), uintptr(unsafe.Pointer(&exitCode)))
+		if exitCode != 0 {
+			errs <- fmt.Errorf("osqueryd exited with code %d. Got: '%s'", exitCode, stderr.String())
+		}
+	}()
+
+	return rows, errs
+}
+
+// ExecOsqueryAsUserWindows runs osquery in the context of username's active
+// WTS session, returning the result as JSON bytes. It's kept for backward
+// compatibility with callers that want bytes rather than rows; the bytes
+// are the decoded rows re-encoded with json.Marshal, not osqueryd's raw
+// stdout, so a query with no rows yields `null`.
+// ExecOsqueryAsUserWindowsParsed (or the streaming API) should be preferred
+// for new code.
+func ExecOsqueryAsUserWindows(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]byte, error) {
+	osqueryResults, err := ExecOsqueryAsUserWindowsParsed(ctx, timeoutSeconds, username, osqueryPath, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(osqueryResults)
+}
+
+// ExecOsqueryAsUserWindowsResult runs osquery in username's active WTS
+// session, and returns an ExecResult carrying stdout alongside stderr, the
+// process's exit code, and wall-clock duration -- even when the command
+// fails, so callers can surface diagnostics instead of just an error.
+func ExecOsqueryAsUserWindowsResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	sessionID, err := findUserSessionID(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var userToken syscall.Handle
+	ret, _, err := procWTSQueryUserToken.Call(uintptr(sessionID), uintptr(unsafe.Pointer(&userToken)))
+	if ret == 0 {
+		return nil, fmt.Errorf("WTSQueryUserToken for session %d: %w", sessionID, err)
+	}
+	defer syscall.CloseHandle(userToken)
+
+	dir, err := os.MkdirTemp("", "osq-createprocess")
+	if err != nil {
+		return nil, fmt.Errorf("mktemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	dirPtr, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return nil, fmt.Errorf("encoding working directory: %w", err)
+	}
+
+	var envBlock uintptr
+	if ret, _, err := procCreateEnvironmentBlock.Call(uintptr(unsafe.Pointer(&envBlock)), uintptr(userToken), 0); ret == 0 {
+		return nil, fmt.Errorf("CreateEnvironmentBlock: %w", err)
+	}
+	defer procDestroyEnvironmentBlock.Call(envBlock)
+
+	cmdLine := fmt.Sprintf(`%s --config_path NUL --disable_events --disable_database --disable_audit --ephemeral -S --json %s`, quoteWindowsArg(osqueryPath), quoteWindowsArg(query))
+	cmdLinePtr, err := syscall.UTF16PtrFromString(cmdLine)
+	if err != nil {
+		return nil, fmt.Errorf("encoding command line: %w", err)
+	}
+
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout pipe: %w", err)
+	}
+	defer stdoutRead.Close()
+
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stderr pipe: %w", err)
+	}
+	defer stderrRead.Close()
+
+	si := new(syscall.StartupInfo)
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	si.Flags = startfUsestdhandles
+	si.StdOutput = syscall.Handle(stdoutWrite.Fd())
+	si.StdErr = syscall.Handle(stderrWrite.Fd())
+
+	pi := new(syscall.ProcessInformation)
+
+	start := time.Now()
+	ret, _, err = procCreateProcessAsUserW.Call(
+		uintptr(userToken),
+		0,
+		uintptr(unsafe.Pointer(cmdLinePtr)),
+		0,
+		0,
+		1,
+		uintptr(createUnicodeEnvironment|createNoWindow),
+		envBlock,
+		uintptr(unsafe.Pointer(dirPtr)),
+		uintptr(unsafe.Pointer(si)),
+		uintptr(unsafe.Pointer(pi)),
+	)
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if ret == 0 {
+		return nil, fmt.Errorf("CreateProcessAsUserW: %w", err)
+	}
+	defer syscall.CloseHandle(pi.Process)
+	defer syscall.CloseHandle(pi.Thread)
+
+	var stdout, stderr bytes.Buffer
+	copyDone := make(chan struct{})
+	go func() {
+		stdout.ReadFrom(stdoutRead)
+		close(copyDone)
+	}()
+	stderrDone := make(chan struct{})
+	go func() {
+		stderr.ReadFrom(stderrRead)
+		close(stderrDone)
+	}()
+
+	waitDone := make(chan error, 1)
+	go func() {
+		if _, err := syscall.WaitForSingleObject(pi.Process, syscall.INFINITE); err != nil {
+			waitDone <- fmt.Errorf("waiting for osqueryd: %w", err)
+			return
+		}
+		waitDone <- nil
+	}()
+
+	var waitErr error
+	select {
+	case waitErr = <-waitDone:
+	case <-ctx.Done():
+		syscall.TerminateProcess(pi.Process, 1)
+		waitErr = ctx.Err()
+	}
+	<-copyDone
+	<-stderrDone
+
+	var exitCode uint32
+	procGetExitCodeProcess.Call(uintptr(pi.Process), uintptr(unsafe.Pointer(&exitCode)))
+
+	result := &ExecResult{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.String(),
+		ExitCode: int(exitCode),
+		Duration: time.Since(start),
+	}
+
+	if waitErr != nil {
+		return result, waitErr
+	}
+	if exitCode != 0 {
+		return result, fmt.Errorf("osqueryd exited with code %d. Got: '%s'", exitCode, stderr.String())
+	}
+
+	return result, nil
+}
+
+// ExecOsqueryAsUserWindowsParsed runs osquery in username's active WTS
+// session, and returns every row once the command completes. It's a thin,
+// buffering wrapper around ExecOsqueryAsUserWindowsStream kept for callers
+// that want the full result set rather than incremental rows.
+func ExecOsqueryAsUserWindowsParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	rows, errs := ExecOsqueryAsUserWindowsStream(ctx, timeoutSeconds, username, osqueryPath, query)
+
+	var osqueryResults []map[string]string
+	for row := range rows {
+		osqueryResults = append(osqueryResults, row)
+	}
+
+	if err := <-errs; err != nil {
+		log.Info().Err(err).Msg("error execing osquery")
+		return nil, err
+	}
+
+	return osqueryResults, nil
+}
+
+// execOsqueryAsUserParsed is the windows implementation of the
+// cross-platform dispatcher used by Table.generate. It targets the WTS
+// session belonging to the requested username, found via
+// findUserSessionID.
+func execOsqueryAsUserParsed(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) ([]map[string]string, error) {
+	return ExecOsqueryAsUserWindowsParsed(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserStream is the windows implementation of the
+// cross-platform streaming dispatcher used by Table.generate.
+func execOsqueryAsUserStream(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (<-chan map[string]string, <-chan error) {
+	return ExecOsqueryAsUserWindowsStream(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// execOsqueryAsUserResult is the windows implementation of the
+// cross-platform diagnostics dispatcher used by Table.generate's debug=1
+// path.
+func execOsqueryAsUserResult(ctx context.Context, timeoutSeconds int, username string, osqueryPath string, query string) (*ExecResult, error) {
+	return ExecOsqueryAsUserWindowsResult(ctx, timeoutSeconds, username, osqueryPath, query)
+}
+
+// discoverLoggedInUsers enumerates users with an active session via
+// WTSEnumerateSessionsW, resolving each active session's username with
+// WTSQuerySessionInformationW.
+func discoverLoggedInUsers(ctx context.Context) ([]string, error) {
+	return walkActiveSessions(func(sessionID uint32, name string) bool {
+		return true
+	})
+}
+
+// findUserSessionID walks the active WTS sessions the same way
+// discoverLoggedInUsers does, returning the session id belonging to
+// username. This is what lets the exec path target a specific logged-in
+// user on a multi-session Windows host, instead of always running against
+// WTSGetActiveConsoleSessionId's single console session.
+func findUserSessionID(username string) (uint32, error) {
+	var found uint32
+	ok := false
+
+	if _, err := walkActiveSessions(func(sessionID uint32, name string) bool {
+		if name == username {
+			found = sessionID
+			ok = true
+			return false
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, fmt.Errorf("no active session for user %s", username)
+	}
+
+	return found, nil
+}
+
+// walkActiveSessions enumerates active WTS sessions via
+// WTSEnumerateSessionsW, resolving each one's username with
+// WTSQuerySessionInformationW, and calls visit(sessionID, username) for
+// each. It stops early if visit returns false. The returned slice
+// collects every username passed to visit, deduplicated, including the
+// one whose visit returned false and stopped the walk, which
+// satisfies discoverLoggedInUsers' contract; callers that only want the
+// first match (like findUserSessionID) can ignore it.
+func walkActiveSessions(visit func(sessionID uint32, username string) bool) ([]string, error) {
+	var sessionInfo *wtsSessionInfo
+	var count uint32
+
+	ret, _, err := procWTSEnumerateSessionsW.Call(0, 0, 1, uintptr(unsafe.Pointer(&sessionInfo)), uintptr(unsafe.Pointer(&count)))
+	if ret == 0 {
+		return nil, fmt.Errorf("WTSEnumerateSessionsW: %w", err)
+	}
+	defer procWTSFreeMemory.Call(uintptr(unsafe.Pointer(sessionInfo)))
+
+	var users []string
+	seen := make(map[string]bool)
+
+	sessions := unsafe.Slice(sessionInfo, int(count))
+	for _, s := range sessions {
+		if s.State != wtsActive {
+			continue
+		}
+
+		var buf *uint16
+		var bytesReturned uint32
+		ret, _, _ := procWTSQuerySessionInformationW.Call(
+			0,
+			uintptr(s.SessionID),
+			wtsUserNameInfo,
+			uintptr(unsafe.Pointer(&buf)),
+			uintptr(unsafe.Pointer(&bytesReturned)),
+		)
+		if ret == 0 || buf == nil {
+			continue
+		}
+
+		name := syscall.UTF16ToString(unsafe.Slice(buf, bytesReturned/2))
+		procWTSFreeMemory.Call(uintptr(unsafe.Pointer(buf)))
+
+		if name == "" {
+			continue
+		}
+
+		keepGoing := visit(s.SessionID, name)
+
+		if !seen[name] {
+			seen[name] = true
+			users = append(users, name)
+		}
+
+		if !keepGoing {
+			break
+		}
+	}
+
+	return users, nil
+}